@@ -0,0 +1,196 @@
+package kbucket
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// PeerInfo holds all the information we track about a peer that lives in a
+// bucket of the RoutingTable.
+type PeerInfo struct {
+	// Id is the peer's ID.
+	Id peer.ID
+
+	// dhtId is the Kademlia key for Id, cached here so we don't have to
+	// re-derive it on every comparison.
+	dhtId ID
+
+	// LastUsefulAt is the last time this peer was "useful" to us, i.e. it
+	// answered a query and returned peers closer to the target than what we
+	// already had.
+	LastUsefulAt time.Time
+
+	// LastSuccessfulOutboundQueryAt is the last time we got a successful
+	// query response of any kind from this peer.
+	LastSuccessfulOutboundQueryAt time.Time
+
+	// AddedAt is the time this peer was added to the routing table.
+	AddedAt time.Time
+
+	// Replaceable marks this peer as a candidate for eviction even before it
+	// has crossed the usefulness grace period, e.g. because some other part
+	// of the system has flagged it as low value.
+	Replaceable bool
+
+	// NumFailures is the number of consecutive times this peer has been
+	// reported dead via HandlePeerDead since its last HandlePeerAlive.
+	NumFailures int
+
+	// LastFailure is the last time HandlePeerDead was called for this peer.
+	LastFailure time.Time
+}
+
+// Bucket holds a list of peers, ordered from most-recently to
+// least-recently used.
+type Bucket struct {
+	lk   sync.RWMutex
+	list *list.List
+}
+
+func newBucket() *Bucket {
+	b := new(Bucket)
+	b.list = list.New()
+	return b
+}
+
+// Peers returns the ids of all peers in the bucket.
+func (b *Bucket) Peers() []peer.ID {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	ps := make([]peer.ID, 0, b.list.Len())
+	for e := b.list.Front(); e != nil; e = e.Next() {
+		ps = append(ps, e.Value.(*PeerInfo).Id)
+	}
+	return ps
+}
+
+// Has returns true if the bucket contains the given peer.
+func (b *Bucket) Has(id peer.ID) bool {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	return b.find(id) != nil
+}
+
+// find returns the list element for the given peer, or nil. Callers must
+// hold (at least) the read lock.
+func (b *Bucket) find(id peer.ID) *list.Element {
+	for e := b.list.Front(); e != nil; e = e.Next() {
+		if e.Value.(*PeerInfo).Id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// getPeerInfo returns a copy of the PeerInfo tracked for id, or nil if the
+// peer is not in this bucket.
+func (b *Bucket) getPeerInfo(id peer.ID) *PeerInfo {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	if e := b.find(id); e != nil {
+		cp := *e.Value.(*PeerInfo)
+		return &cp
+	}
+	return nil
+}
+
+// updatePeerInfo applies fn to the PeerInfo tracked for id, if present, and
+// reports whether the peer was found.
+func (b *Bucket) updatePeerInfo(id peer.ID, fn func(*PeerInfo)) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if e := b.find(id); e != nil {
+		fn(e.Value.(*PeerInfo))
+		return true
+	}
+	return false
+}
+
+func (b *Bucket) Remove(id peer.ID) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if e := b.find(id); e != nil {
+		b.list.Remove(e)
+		return true
+	}
+	return false
+}
+
+func (b *Bucket) MoveToFront(id peer.ID) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if e := b.find(id); e != nil {
+		b.list.MoveToFront(e)
+	}
+}
+
+func (b *Bucket) PushFront(p *PeerInfo) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.list.PushFront(p)
+}
+
+func (b *Bucket) PopBack() *PeerInfo {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	last := b.list.Back()
+	if last == nil {
+		return nil
+	}
+	b.list.Remove(last)
+	return last.Value.(*PeerInfo)
+}
+
+func (b *Bucket) Len() int {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	return b.list.Len()
+}
+
+// oldestReplaceableCandidate scans the bucket for the peer with the oldest
+// LastUsefulAt that is eligible for eviction, i.e. it is explicitly marked
+// Replaceable or its usefulness has not been refreshed within gracePeriod.
+// It returns nil if no peer in the bucket qualifies.
+func (b *Bucket) oldestReplaceableCandidate(gracePeriod time.Duration) *PeerInfo {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+
+	var oldest *PeerInfo
+	for e := b.list.Front(); e != nil; e = e.Next() {
+		pi := e.Value.(*PeerInfo)
+		if !pi.Replaceable && time.Since(pi.LastUsefulAt) < gracePeriod {
+			continue
+		}
+		if oldest == nil || pi.LastUsefulAt.Before(oldest.LastUsefulAt) {
+			oldest = pi
+		}
+	}
+	return oldest
+}
+
+// Split splits a bucket's peers into two buckets. The receiver keeps peers
+// whose CPL with target is <= cpl; the returned bucket holds the peers with
+// CPL greater than cpl (i.e. the closer peers).
+func (b *Bucket) Split(cpl int, target ID) *Bucket {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	newbuck := newBucket()
+	e := b.list.Front()
+	for e != nil {
+		pi := e.Value.(*PeerInfo)
+		peerCPL := CommonPrefixLen(pi.dhtId, target)
+		if peerCPL > cpl {
+			cur := e
+			e = e.Next()
+			b.list.Remove(cur)
+			newbuck.list.PushBack(pi)
+			continue
+		}
+		e = e.Next()
+	}
+	return newbuck
+}
@@ -0,0 +1,180 @@
+package kbucket
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	ma "github.com/multiformats/go-multiaddr"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// ErrPeerRejectedNoDiversity is returned by Update when admitting a peer
+// would push one of its IP groups over the configured diversity limit for
+// that bucket or for the table as a whole.
+var ErrPeerRejectedNoDiversity = errors.New("peer rejected; insufficient IP diversity")
+
+// defaultIPv4PrefixLen and defaultIPv6PrefixLen are the customary group
+// granularities: a /16 for IPv4 and a /32 for IPv6, which is roughly one
+// allocation unit for each address family. NewDefaultPeerDiversityFilter does
+// not apply them itself; it uses the prefix lengths its caller passes in.
+const (
+	defaultIPv4PrefixLen = 16
+	defaultIPv6PrefixLen = 32
+)
+
+// PeerDiversityFilter lets a RoutingTable bound how many peers from the same
+// network group (e.g. the same /16) it will accept, to blunt Sybil clusters
+// launched from a single subnet.
+type PeerDiversityFilter interface {
+	// Allow reports whether p, with the given known addresses, may occupy a
+	// slot in bucketID. Implementations that need addresses beyond what's
+	// passed in (addrs may be nil) are free to consult their own peerstore.
+	Allow(bucketID int, p peer.ID, addrs []ma.Multiaddr) bool
+
+	// Remove tells the filter that p is no longer in the table, so it can
+	// drop any bookkeeping it was holding for it.
+	Remove(p peer.ID)
+}
+
+// defaultPeerDiversityFilter is the table's built-in PeerDiversityFilter. It
+// groups peers by IPv4 /ipv4PrefixLen and IPv6 /ipv6PrefixLen network
+// prefixes and caps how many peers from the same group may share a bucket or
+// the table as a whole.
+type defaultPeerDiversityFilter struct {
+	ps pstore.Peerstore
+
+	ipv4PrefixLen int
+	ipv6PrefixLen int
+
+	maxPeersPerGroupInBucket int
+	maxPeersPerGroupInTable  int
+
+	mu           sync.Mutex
+	bucketGroups map[int]map[string]map[peer.ID]struct{}
+	tableGroups  map[string]map[peer.ID]struct{}
+}
+
+// NewDefaultPeerDiversityFilter builds the table's default diversity filter.
+// It looks up addresses for a peer from ps when Allow isn't given any
+// directly.
+func NewDefaultPeerDiversityFilter(ps pstore.Peerstore, ipv4PrefixLen, ipv6PrefixLen, maxPeersPerGroupInBucket, maxPeersPerGroupInTable int) *defaultPeerDiversityFilter {
+	return &defaultPeerDiversityFilter{
+		ps: ps,
+
+		ipv4PrefixLen: ipv4PrefixLen,
+		ipv6PrefixLen: ipv6PrefixLen,
+
+		maxPeersPerGroupInBucket: maxPeersPerGroupInBucket,
+		maxPeersPerGroupInTable:  maxPeersPerGroupInTable,
+
+		bucketGroups: make(map[int]map[string]map[peer.ID]struct{}),
+		tableGroups:  make(map[string]map[peer.ID]struct{}),
+	}
+}
+
+func (f *defaultPeerDiversityFilter) Allow(bucketID int, p peer.ID, addrs []ma.Multiaddr) bool {
+	groups := f.groupsFor(p, addrs)
+	if len(groups) == 0 {
+		// no known address to group by; nothing to enforce.
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, g := range groups {
+		if f.count(f.tableGroups[g], p) >= f.maxPeersPerGroupInTable {
+			return false
+		}
+		if f.count(f.bucketGroups[bucketID][g], p) >= f.maxPeersPerGroupInBucket {
+			return false
+		}
+	}
+
+	for _, g := range groups {
+		if f.tableGroups[g] == nil {
+			f.tableGroups[g] = make(map[peer.ID]struct{})
+		}
+		f.tableGroups[g][p] = struct{}{}
+
+		if f.bucketGroups[bucketID] == nil {
+			f.bucketGroups[bucketID] = make(map[string]map[peer.ID]struct{})
+		}
+		if f.bucketGroups[bucketID][g] == nil {
+			f.bucketGroups[bucketID][g] = make(map[peer.ID]struct{})
+		}
+		f.bucketGroups[bucketID][g][p] = struct{}{}
+	}
+	return true
+}
+
+func (f *defaultPeerDiversityFilter) Remove(p peer.ID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, members := range f.tableGroups {
+		delete(members, p)
+	}
+	for _, groups := range f.bucketGroups {
+		for _, members := range groups {
+			delete(members, p)
+		}
+	}
+}
+
+// count returns how many distinct peers are already tracked under members,
+// not counting p itself (so re-admitting an already-tracked peer, e.g. on a
+// MoveToFront, doesn't double count against the limit).
+func (f *defaultPeerDiversityFilter) count(members map[peer.ID]struct{}, p peer.ID) int {
+	if _, ok := members[p]; ok {
+		return len(members) - 1
+	}
+	return len(members)
+}
+
+// groupsFor returns the network group keys (one per address family
+// represented) that p belongs to, preferring the addrs passed in and falling
+// back to the configured peerstore.
+func (f *defaultPeerDiversityFilter) groupsFor(p peer.ID, addrs []ma.Multiaddr) []string {
+	if len(addrs) == 0 && f.ps != nil {
+		addrs = f.ps.Addrs(p)
+	}
+
+	seen := make(map[string]struct{})
+	var groups []string
+	for _, addr := range addrs {
+		g := f.groupKey(addr)
+		if g == "" {
+			continue
+		}
+		if _, ok := seen[g]; ok {
+			continue
+		}
+		seen[g] = struct{}{}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+func (f *defaultPeerDiversityFilter) groupKey(addr ma.Multiaddr) string {
+	if v, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return ""
+		}
+		masked := ip.Mask(net.CIDRMask(f.ipv4PrefixLen, 32))
+		return "4:" + masked.String()
+	}
+	if v, err := addr.ValueForProtocol(ma.P_IP6); err == nil {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return ""
+		}
+		masked := ip.Mask(net.CIDRMask(f.ipv6PrefixLen, 128))
+		return "6:" + masked.String()
+	}
+	return ""
+}
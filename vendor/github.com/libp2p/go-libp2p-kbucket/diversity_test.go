@@ -0,0 +1,69 @@
+package kbucket
+
+import (
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func mustAddr(t *testing.T, s string) ma.Multiaddr {
+	t.Helper()
+	a, err := ma.NewMultiaddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestDefaultPeerDiversityFilterBucketLimit(t *testing.T) {
+	f := NewDefaultPeerDiversityFilter(nil, 16, 32, 2, 10)
+
+	sameGroup := []ma.Multiaddr{mustAddr(t, "/ip4/10.0.0.1/tcp/4001")}
+	p1, p2, p3 := randPeerID(t), randPeerID(t), randPeerID(t)
+
+	if !f.Allow(0, p1, sameGroup) {
+		t.Fatal("expected first peer in group to be allowed")
+	}
+	if !f.Allow(0, p2, sameGroup) {
+		t.Fatal("expected second peer in group to be allowed")
+	}
+	if f.Allow(0, p3, sameGroup) {
+		t.Fatal("expected third peer in the same bucket/group to be rejected past maxPeersPerGroupInBucket")
+	}
+
+	f.Remove(p1)
+	if !f.Allow(0, p3, sameGroup) {
+		t.Fatal("expected p3 to be allowed after freeing up a slot via Remove")
+	}
+}
+
+func TestDefaultPeerDiversityFilterTableLimit(t *testing.T) {
+	f := NewDefaultPeerDiversityFilter(nil, 16, 32, 10, 1)
+
+	sameGroup := []ma.Multiaddr{mustAddr(t, "/ip4/10.0.0.1/tcp/4001")}
+	p1, p2 := randPeerID(t), randPeerID(t)
+
+	if !f.Allow(0, p1, sameGroup) {
+		t.Fatal("expected first peer to be allowed")
+	}
+	// Different bucket, but the same network group should still be capped
+	// by maxPeersPerGroupInTable.
+	if f.Allow(1, p2, sameGroup) {
+		t.Fatal("expected second peer from the same group to be rejected past maxPeersPerGroupInTable")
+	}
+}
+
+func TestDefaultPeerDiversityFilterDistinctGroupsUnaffected(t *testing.T) {
+	f := NewDefaultPeerDiversityFilter(nil, 16, 32, 1, 1)
+
+	a1 := []ma.Multiaddr{mustAddr(t, "/ip4/10.0.0.1/tcp/4001")}
+	a2 := []ma.Multiaddr{mustAddr(t, "/ip4/192.168.0.1/tcp/4001")}
+	p1, p2 := randPeerID(t), randPeerID(t)
+
+	if !f.Allow(0, p1, a1) {
+		t.Fatal("expected first peer to be allowed")
+	}
+	if !f.Allow(0, p2, a2) {
+		t.Fatal("expected peer from a distinct /16 to be unaffected by the first peer's quota")
+	}
+}
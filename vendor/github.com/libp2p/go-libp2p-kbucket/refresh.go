@@ -0,0 +1,146 @@
+package kbucket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultRefreshInterval is how often the RefreshManager checks the table
+// for under-populated or stale CPLs.
+const defaultRefreshInterval = 10 * time.Minute
+
+// defaultRefreshStaleness is how old a bucket's most-recently-useful peer
+// may be before the bucket is considered stale and worth refreshing, even if
+// it's at capacity.
+const defaultRefreshStaleness = 1 * time.Hour
+
+// LookupFunc performs a DHT lookup for targetID, discovering (and
+// presumably feeding into the routing table) any peers closer to it.
+type LookupFunc func(ctx context.Context, targetID ID) error
+
+// RefreshManager periodically inspects a RoutingTable's CPL coverage and
+// triggers lookups for CPLs that are under-populated or whose peers haven't
+// been useful in a while, so the table stays healthy without waiting for
+// those buckets to be exercised by real traffic.
+type RefreshManager struct {
+	rt        *RoutingTable
+	lookup    LookupFunc
+	interval  time.Duration
+	staleness time.Duration
+
+	triggerLk sync.Mutex
+	trigger   chan uint
+
+	// TrackedCplForRefresh is the highest CPL the manager has ever scheduled
+	// a refresh for, exposed for observability.
+	TrackedCplForRefresh uint
+}
+
+// NewRefreshManager builds a RefreshManager for rt that uses lookup to drive
+// refresh queries. Use SetInterval and SetStaleness below to override
+// defaults before calling Run.
+func NewRefreshManager(rt *RoutingTable, lookup LookupFunc) *RefreshManager {
+	return &RefreshManager{
+		rt:        rt,
+		lookup:    lookup,
+		interval:  defaultRefreshInterval,
+		staleness: defaultRefreshStaleness,
+		trigger:   make(chan uint, 1),
+	}
+}
+
+// SetInterval overrides the default tick interval between refresh passes.
+func (m *RefreshManager) SetInterval(d time.Duration) {
+	m.interval = d
+}
+
+// SetStaleness overrides how old a bucket's most-recently-useful peer may be
+// before the bucket is refreshed even though it's at capacity.
+func (m *RefreshManager) SetStaleness(d time.Duration) {
+	m.staleness = d
+}
+
+// Run drives the refresh loop until ctx is cancelled. It ticks every
+// interval and additionally reacts to RefreshNow calls.
+func (m *RefreshManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.refreshAll(ctx)
+		case cpl := <-m.trigger:
+			m.refreshCpl(ctx, cpl)
+		}
+	}
+}
+
+// RefreshNow schedules an out-of-band refresh of the given CPL, bypassing
+// the normal tick interval.
+func (m *RefreshManager) RefreshNow(cpl uint) {
+	m.triggerLk.Lock()
+	defer m.triggerLk.Unlock()
+	select {
+	case m.trigger <- cpl:
+	default:
+		// a refresh is already pending, so this request is dropped; the next
+		// tick refreshes this CPL only if needsRefresh reports it.
+	}
+}
+
+// refreshAll walks every CPL the table currently cares about and refreshes
+// the ones that need it.
+func (m *RefreshManager) refreshAll(ctx context.Context) {
+	m.rt.tabLock.RLock()
+	maxCpl := uint(len(m.rt.Buckets) - 1)
+	m.rt.tabLock.RUnlock()
+
+	for cpl := uint(0); cpl <= maxCpl; cpl++ {
+		if m.needsRefresh(cpl) {
+			m.refreshCpl(ctx, cpl)
+		}
+	}
+}
+
+// needsRefresh reports whether cpl is under-populated relative to
+// bucketsize, or its peers haven't been useful recently.
+func (m *RefreshManager) needsRefresh(cpl uint) bool {
+	peers := m.rt.GetPeersForCpl(cpl)
+	if len(peers) < m.rt.bucketsize {
+		return true
+	}
+
+	newestUsefulness := time.Time{}
+	for _, p := range peers {
+		if pi := m.rt.PeerInfo(p); pi != nil && pi.LastUsefulAt.After(newestUsefulness) {
+			newestUsefulness = pi.LastUsefulAt
+		}
+	}
+	return time.Since(newestUsefulness) > m.staleness
+}
+
+// refreshCpl generates a random target in cpl's slice of the keyspace and
+// hands it to LookupFunc.
+func (m *RefreshManager) refreshCpl(ctx context.Context, cpl uint) {
+	if cpl > m.TrackedCplForRefresh {
+		m.TrackedCplForRefresh = cpl
+	}
+
+	target, err := m.rt.GenRandPeerID(cpl)
+	if err != nil {
+		log.Debugf("refresh: failed to generate target for cpl %d: %s", cpl, err)
+		return
+	}
+
+	// target's bytes already share exactly cpl bits of prefix with the local
+	// ID in keyspace; it must be used as the keyspace ID directly rather
+	// than re-hashed via ConvertPeerID, which would scatter it to an
+	// unrelated CPL.
+	if err := m.lookup(ctx, ID([]byte(target))); err != nil {
+		log.Debugf("refresh: lookup for cpl %d failed: %s", cpl, err)
+	}
+}
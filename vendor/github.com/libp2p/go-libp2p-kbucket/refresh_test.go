@@ -0,0 +1,56 @@
+package kbucket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+func TestGenRandPeerIDMatchesRequestedCpl(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+	rt := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	for cpl := uint(0); cpl < 6; cpl++ {
+		target, err := rt.GenRandPeerID(cpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The bytes generated by GenRandPeerID are a keyspace ID in their
+		// own right; they must NOT be re-hashed via ConvertPeerID to find
+		// their CPL.
+		got := uint(CommonPrefixLen(ID([]byte(target)), local))
+		if got != cpl {
+			t.Errorf("expected generated target to have cpl %d with local, got %d", cpl, got)
+		}
+	}
+}
+
+func TestRefreshManagerTargetsRequestedCpl(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+	rt := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	var lookedUp []ID
+	m := NewRefreshManager(rt, func(ctx context.Context, target ID) error {
+		lookedUp = append(lookedUp, target)
+		return nil
+	})
+
+	for cpl := uint(0); cpl < 4; cpl++ {
+		m.refreshCpl(context.Background(), cpl)
+	}
+
+	if len(lookedUp) != 4 {
+		t.Fatalf("expected 4 lookups, got %d", len(lookedUp))
+	}
+	for cpl, target := range lookedUp {
+		if got := CommonPrefixLen(target, local); got != cpl {
+			t.Errorf("lookup %d: expected target to share cpl %d with local, got %d", cpl, cpl, got)
+		}
+	}
+
+	if m.TrackedCplForRefresh != 3 {
+		t.Errorf("expected TrackedCplForRefresh to be 3, got %d", m.TrackedCplForRefresh)
+	}
+}
@@ -0,0 +1,180 @@
+package kbucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// snapshotSchemaVersion is bumped whenever the on-disk snapshot format
+// changes incompatibly. Restore refuses to load a snapshot from a version it
+// doesn't understand rather than guessing at the layout.
+const snapshotSchemaVersion byte = 1
+
+type snapshotPeer struct {
+	Id                            peer.ID
+	DhtId                         ID
+	LastUsefulAt                  time.Time
+	LastSuccessfulOutboundQueryAt time.Time
+	AddedAt                       time.Time
+}
+
+type snapshotData struct {
+	Buckets [][]snapshotPeer
+}
+
+// Snapshot serializes every peer's PeerInfo plus the bucket layout, so it
+// can later be handed to Restore to warm-boot the table on startup instead
+// of rebuilding it from scratch via bootstrap.
+func (rt *RoutingTable) Snapshot() ([]byte, error) {
+	rt.tabLock.RLock()
+	defer rt.tabLock.RUnlock()
+
+	data := snapshotData{Buckets: make([][]snapshotPeer, len(rt.Buckets))}
+	for i, b := range rt.Buckets {
+		b.lk.RLock()
+		for e := b.list.Front(); e != nil; e = e.Next() {
+			pi := e.Value.(*PeerInfo)
+			data.Buckets[i] = append(data.Buckets[i], snapshotPeer{
+				Id:                            pi.Id,
+				DhtId:                         pi.dhtId,
+				LastUsefulAt:                  pi.LastUsefulAt,
+				LastSuccessfulOutboundQueryAt: pi.LastSuccessfulOutboundQueryAt,
+				AddedAt:                       pi.AddedAt,
+			})
+		}
+		b.lk.RUnlock()
+	}
+
+	body, err := cbor.DumpObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode routing table snapshot: %s", err)
+	}
+	return append([]byte{snapshotSchemaVersion}, body...), nil
+}
+
+// Restore replaces the table's contents with the peers recorded in data, as
+// produced by an earlier Snapshot. now seeds AddedAt/LastUsefulAt for any
+// peer whose recorded timestamps come back zero. A snapshot decoding to zero
+// buckets is rejected rather than applied, since a RoutingTable must always
+// have at least one bucket. If a diversity filter is configured, restored
+// peers are re-admitted through it so its group accounting doesn't fall out
+// of sync with the table it's meant to be guarding.
+func (rt *RoutingTable) Restore(data []byte, now time.Time) error {
+	if len(data) == 0 {
+		return errors.New("empty routing table snapshot")
+	}
+
+	version, body := data[0], data[1:]
+	if version != snapshotSchemaVersion {
+		return fmt.Errorf("unsupported routing table snapshot schema version %d", version)
+	}
+
+	var decoded snapshotData
+	if err := cbor.DecodeInto(body, &decoded); err != nil {
+		return fmt.Errorf("failed to decode routing table snapshot: %s", err)
+	}
+	if len(decoded.Buckets) == 0 {
+		return errors.New("routing table snapshot has no buckets")
+	}
+
+	rt.tabLock.Lock()
+	defer rt.tabLock.Unlock()
+
+	buckets := make([]*Bucket, len(decoded.Buckets))
+	for i, peers := range decoded.Buckets {
+		bucket := newBucket()
+		for _, sp := range peers {
+			pi := &PeerInfo{
+				Id:                            sp.Id,
+				dhtId:                         sp.DhtId,
+				LastUsefulAt:                  sp.LastUsefulAt,
+				LastSuccessfulOutboundQueryAt: sp.LastSuccessfulOutboundQueryAt,
+				AddedAt:                       sp.AddedAt,
+			}
+			if pi.LastUsefulAt.IsZero() {
+				pi.LastUsefulAt = now
+			}
+			if pi.AddedAt.IsZero() {
+				pi.AddedAt = now
+			}
+			bucket.list.PushBack(pi)
+			// Restored peers bypass admitDiversity, so re-seed the filter's
+			// bookkeeping directly; otherwise its counts would silently fall
+			// out of sync with the table until the peer is next evicted.
+			if rt.diversityFilter != nil {
+				rt.diversityFilter.Allow(i, pi.Id, nil)
+			}
+		}
+		buckets[i] = bucket
+	}
+	rt.Buckets = buckets
+	return nil
+}
+
+// SnapshotStore persists and loads a serialized routing table snapshot.
+type SnapshotStore interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// FSSnapshotStore is a SnapshotStore backed by a single file on disk. Save
+// writes to a temp file and renames it into place so a crash mid-write can't
+// leave a corrupt snapshot behind.
+type FSSnapshotStore struct {
+	path string
+}
+
+// NewFSSnapshotStore returns a SnapshotStore that reads/writes snapshots at
+// path.
+func NewFSSnapshotStore(path string) *FSSnapshotStore {
+	return &FSSnapshotStore{path: path}
+}
+
+func (s *FSSnapshotStore) Load() ([]byte, error) {
+	return ioutil.ReadFile(s.path)
+}
+
+func (s *FSSnapshotStore) Save(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// EnableSnapshots starts a background goroutine that saves a Snapshot to
+// store every interval, until ctx is cancelled. On startup, callers can
+// Load() from store and pass the result to Restore to warm-boot
+// connectivity instead of re-bootstrapping from scratch.
+func (rt *RoutingTable) EnableSnapshots(ctx context.Context, store SnapshotStore, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				data, err := rt.Snapshot()
+				if err != nil {
+					log.Debugf("snapshot: failed to serialize routing table: %s", err)
+					continue
+				}
+				if err := store.Save(data); err != nil {
+					log.Debugf("snapshot: failed to persist routing table: %s", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package kbucket
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+	rt := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	var added []string
+	for i := uint(0); i < 3; i++ {
+		p := randPeerIDWithCPL(t, local, i)
+		if _, err := rt.Update(p); err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, string(p))
+	}
+
+	data, err := rt.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+	if err := restored.Restore(data, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Size() != rt.Size() {
+		t.Fatalf("expected restored table to have %d peers, got %d", rt.Size(), restored.Size())
+	}
+
+	got := make(map[string]bool)
+	for _, p := range restored.ListPeers() {
+		got[string(p)] = true
+	}
+	for _, p := range added {
+		if !got[p] {
+			t.Errorf("expected restored table to contain peer %x", p)
+		}
+	}
+}
+
+func TestRestoreRejectsUnknownSchemaVersion(t *testing.T) {
+	rt := NewRoutingTable(4, ConvertPeerID(randPeerID(t)), time.Hour, pstore.NewMetrics(), 5, time.Minute)
+	if err := rt.Restore([]byte{snapshotSchemaVersion + 1, 0xFF}, time.Now()); err == nil {
+		t.Fatal("expected an error restoring from an unknown schema version")
+	}
+}
+
+func TestRestoreRejectsEmptyBucketList(t *testing.T) {
+	rt := NewRoutingTable(4, ConvertPeerID(randPeerID(t)), time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	body, err := cbor.DumpObject(snapshotData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{snapshotSchemaVersion}, body...)
+
+	bucketsBefore := len(rt.Buckets)
+	if err := rt.Restore(data, time.Now()); err == nil {
+		t.Fatal("expected an error restoring a snapshot with no buckets")
+	}
+	// A rejected Restore must leave the existing table (and its invariant of
+	// always having at least one bucket) untouched.
+	if len(rt.Buckets) != bucketsBefore {
+		t.Errorf("expected Restore to leave rt.Buckets unchanged on error, got %d buckets, want %d", len(rt.Buckets), bucketsBefore)
+	}
+}
+
+// recordingDiversityFilter tracks every peer it's asked to Allow, so tests
+// can verify Restore re-seeds a diversity filter's bookkeeping rather than
+// leaving it to silently fall out of sync with the restored table.
+type recordingDiversityFilter struct {
+	allowed map[peer.ID]bool
+}
+
+func (f *recordingDiversityFilter) Allow(bucketID int, p peer.ID, addrs []ma.Multiaddr) bool {
+	f.allowed[p] = true
+	return true
+}
+
+func (f *recordingDiversityFilter) Remove(p peer.ID) {
+	delete(f.allowed, p)
+}
+
+func TestRestoreReseedsDiversityFilter(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+	rt := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	p := randPeerIDWithCPL(t, local, 0)
+	if _, err := rt.Update(p); err != nil {
+		t.Fatal(err)
+	}
+	data, err := rt.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+	filter := &recordingDiversityFilter{allowed: make(map[peer.ID]bool)}
+	restored.SetDiversityFilter(filter)
+	if err := restored.Restore(data, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !filter.allowed[p] {
+		t.Errorf("expected Restore to re-seed the diversity filter with restored peer %x", p)
+	}
+}
+
+func TestFSSnapshotStoreRoundTrip(t *testing.T) {
+	store := NewFSSnapshotStore(filepath.Join(t.TempDir(), "routing-table.snapshot"))
+
+	want := []byte{snapshotSchemaVersion, 1, 2, 3}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("expected loaded snapshot to match what was saved")
+	}
+}
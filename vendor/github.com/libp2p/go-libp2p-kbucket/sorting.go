@@ -0,0 +1,60 @@
+package kbucket
+
+import (
+	"bytes"
+	"container/list"
+	"sort"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// peerDistance is a helper to sort peers by their distance to a target
+// keyspace ID.
+type peerDistance struct {
+	p        peer.ID
+	distance ID
+}
+
+// peerDistanceSorter sorts a list of peers by ascending distance to target.
+type peerDistanceSorter struct {
+	peers  []peerDistance
+	target ID
+}
+
+func (pds *peerDistanceSorter) Len() int { return len(pds.peers) }
+func (pds *peerDistanceSorter) Swap(a, b int) {
+	pds.peers[a], pds.peers[b] = pds.peers[b], pds.peers[a]
+}
+func (pds *peerDistanceSorter) Less(a, b int) bool {
+	return bytes.Compare(pds.peers[a].distance, pds.peers[b].distance) < 0
+}
+
+func (pds *peerDistanceSorter) appendPeer(p peer.ID, peerID ID) {
+	pds.peers = append(pds.peers, peerDistance{
+		p:        p,
+		distance: xorKeyspaceDistance(peerID, pds.target),
+	})
+}
+
+// appendPeersFromList adds every peer tracked in l, a bucket's backing list
+// of *PeerInfo, to the sorter.
+func (pds *peerDistanceSorter) appendPeersFromList(l *list.List) {
+	for e := l.Front(); e != nil; e = e.Next() {
+		pi := e.Value.(*PeerInfo)
+		pds.appendPeer(pi.Id, pi.dhtId)
+	}
+}
+
+func (pds *peerDistanceSorter) sort() {
+	sort.Sort(pds)
+}
+
+// xorKeyspaceDistance returns the XOR distance between two keyspace IDs of
+// equal length.
+func xorKeyspaceDistance(a, b ID) ID {
+	out := make(ID, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
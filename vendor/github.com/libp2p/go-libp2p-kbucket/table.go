@@ -2,6 +2,7 @@
 package kbucket
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"sync"
@@ -17,6 +18,11 @@ var log = logging.Logger("table")
 var ErrPeerRejectedHighLatency = errors.New("peer rejected; latency too high")
 var ErrPeerRejectedNoCapacity = errors.New("peer rejected; insufficient capacity")
 
+// defaultUsefulnessGracePeriod is how long a peer gets to sit in a full
+// bucket without answering a useful query before it becomes a candidate for
+// eviction in favor of a newcomer.
+const defaultUsefulnessGracePeriod = 1 * time.Hour
+
 // RoutingTable defines the routing table.
 type RoutingTable struct {
 
@@ -36,26 +42,72 @@ type RoutingTable struct {
 	Buckets    []*Bucket
 	bucketsize int
 
+	// usefulnessGracePeriod is how stale a peer's LastUsefulAt may be before
+	// it becomes a replacement candidate in a full bucket.
+	usefulnessGracePeriod time.Duration
+
+	// maxFailures is how many consecutive dead reports a peer can accrue
+	// before HandlePeerDead removes it outright.
+	maxFailures int
+
+	// failureGracePeriod is how close a dead report must follow the previous
+	// one for a count above softMaxFailures to remove a peer even if it hasn't
+	// hit maxFailures yet.
+	failureGracePeriod time.Duration
+
+	// diversityFilter, if set, bounds how many peers from the same network
+	// group Update will admit into a bucket or the table as a whole.
+	diversityFilter PeerDiversityFilter
+
 	// notification functions
 	PeerRemoved func(peer.ID)
 	PeerAdded   func(peer.ID)
 }
 
-// NewRoutingTable creates a new routing table with a given bucketsize, local ID, and latency tolerance.
-func NewRoutingTable(bucketsize int, localID ID, latency time.Duration, m pstore.Metrics) *RoutingTable {
+// softMaxFailures is the failure count above which a peer is marked bad,
+// even below maxFailures, when its latest failure came within
+// failureGracePeriod of the one before it.
+const softMaxFailures = 2
+
+// NewRoutingTable creates a new routing table with a given bucketsize, local
+// ID, latency tolerance, and failure-quarantine policy: a peer is evicted by
+// HandlePeerDead once it accrues maxFailures consecutive failures, or sooner
+// once it has more than softMaxFailures and the latest failure came within
+// failureGracePeriod of the previous one.
+func NewRoutingTable(bucketsize int, localID ID, latency time.Duration, m pstore.Metrics, maxFailures int, failureGracePeriod time.Duration) *RoutingTable {
 	rt := &RoutingTable{
-		Buckets:     []*Bucket{newBucket()},
-		bucketsize:  bucketsize,
-		local:       localID,
-		maxLatency:  latency,
-		metrics:     m,
-		PeerRemoved: func(peer.ID) {},
-		PeerAdded:   func(peer.ID) {},
+		Buckets:               []*Bucket{newBucket()},
+		bucketsize:            bucketsize,
+		local:                 localID,
+		maxLatency:            latency,
+		metrics:               m,
+		usefulnessGracePeriod: defaultUsefulnessGracePeriod,
+		maxFailures:           maxFailures,
+		failureGracePeriod:    failureGracePeriod,
+		PeerRemoved:           func(peer.ID) {},
+		PeerAdded:             func(peer.ID) {},
 	}
 
 	return rt
 }
 
+// SetUsefulnessGracePeriod configures how long a peer may go without being
+// marked useful before it becomes an eviction candidate in a full bucket.
+func (rt *RoutingTable) SetUsefulnessGracePeriod(d time.Duration) {
+	rt.tabLock.Lock()
+	defer rt.tabLock.Unlock()
+	rt.usefulnessGracePeriod = d
+}
+
+// SetDiversityFilter installs f to bound how many peers from the same
+// network group Update will admit into a bucket or the table. Existing
+// callers that never call this keep the old unbounded behavior.
+func (rt *RoutingTable) SetDiversityFilter(f PeerDiversityFilter) {
+	rt.tabLock.Lock()
+	defer rt.tabLock.Unlock()
+	rt.diversityFilter = f
+}
+
 // Update adds or moves the given peer to the front of its respective bucket
 func (rt *RoutingTable) Update(p peer.ID) (evicted peer.ID, err error) {
 	peerID := ConvertPeerID(p)
@@ -82,9 +134,20 @@ func (rt *RoutingTable) Update(p peer.ID) (evicted peer.ID, err error) {
 		return "", ErrPeerRejectedHighLatency
 	}
 
+	now := time.Now()
+	newPeer := &PeerInfo{
+		Id:           p,
+		dhtId:        peerID,
+		LastUsefulAt: now,
+		AddedAt:      now,
+	}
+
 	// We have enough space in the bucket (whether spawned or grouped).
 	if bucket.Len() < rt.bucketsize {
-		bucket.PushFront(p)
+		if !rt.admitDiversity(bucketID, p) {
+			return "", ErrPeerRejectedNoDiversity
+		}
+		bucket.PushFront(newPeer)
 		rt.PeerAdded(p)
 		return "", nil
 	}
@@ -99,17 +162,271 @@ func (rt *RoutingTable) Update(p peer.ID) (evicted peer.ID, err error) {
 		}
 		bucket = rt.Buckets[bucketID]
 		if bucket.Len() >= rt.bucketsize {
-			// if after all the unfolding, we're unable to find room for this peer, scrap it.
-			return "", ErrPeerRejectedNoCapacity
+			if !rt.admitDiversity(bucketID, p) {
+				return "", ErrPeerRejectedNoDiversity
+			}
+			ev, ok := rt.evictForNewcomer(bucket)
+			if !ok {
+				// if after all the unfolding, we're unable to find room for this peer, scrap it.
+				// admitDiversity already reserved p's slot above; release it since it never
+				// actually landed in a bucket.
+				rt.releaseDiversity(p)
+				return "", ErrPeerRejectedNoCapacity
+			}
+			bucket.PushFront(newPeer)
+			rt.PeerAdded(p)
+			return ev, nil
 		}
-		bucket.PushFront(p)
+		if !rt.admitDiversity(bucketID, p) {
+			return "", ErrPeerRejectedNoDiversity
+		}
+		bucket.PushFront(newPeer)
 		rt.PeerAdded(p)
 		return "", nil
 	}
 
+	if !rt.admitDiversity(bucketID, p) {
+		return "", ErrPeerRejectedNoDiversity
+	}
+
+	if ev, ok := rt.evictForNewcomer(bucket); ok {
+		bucket.PushFront(newPeer)
+		rt.PeerAdded(p)
+		return ev, nil
+	}
+
+	// admitDiversity already reserved p's slot above; release it since it
+	// never actually landed in a bucket.
+	rt.releaseDiversity(p)
 	return "", ErrPeerRejectedNoCapacity
 }
 
+// admitDiversity consults the diversity filter, if any, for p's placement in
+// bucketID. It's checked before any eviction so a diversity rejection never
+// has a side effect on the table. It records p against the filter's group
+// accounting as soon as it returns true; callers that go on to reject p for
+// another reason (e.g. no eviction candidate) must undo that via
+// releaseDiversity.
+func (rt *RoutingTable) admitDiversity(bucketID int, p peer.ID) bool {
+	if rt.diversityFilter == nil {
+		return true
+	}
+	return rt.diversityFilter.Allow(bucketID, p, nil)
+}
+
+// releaseDiversity undoes the bookkeeping admitDiversity recorded for p when
+// Update ultimately fails to seat it for a reason other than diversity.
+func (rt *RoutingTable) releaseDiversity(p peer.ID) {
+	if rt.diversityFilter == nil {
+		return
+	}
+	rt.diversityFilter.Remove(p)
+}
+
+// evictForNewcomer looks for a peer in bucket that is past its usefulness
+// grace period or explicitly marked Replaceable, evicts it, and reports its
+// ID. It returns ok=false if the bucket has no eviction candidate.
+func (rt *RoutingTable) evictForNewcomer(bucket *Bucket) (evicted peer.ID, ok bool) {
+	candidate := bucket.oldestReplaceableCandidate(rt.usefulnessGracePeriod)
+	if candidate == nil {
+		return "", false
+	}
+	bucket.Remove(candidate.Id)
+	if rt.diversityFilter != nil {
+		rt.diversityFilter.Remove(candidate.Id)
+	}
+	rt.PeerRemoved(candidate.Id)
+	return candidate.Id, true
+}
+
+// UpdateLastUsefulAt records the last time p answered a useful query, e.g.
+// one that returned peers closer to the target than what we already had.
+func (rt *RoutingTable) UpdateLastUsefulAt(p peer.ID, t time.Time) {
+	rt.tabLock.Lock()
+	defer rt.tabLock.Unlock()
+	bucket := rt.bucketFor(p)
+	bucket.updatePeerInfo(p, func(pi *PeerInfo) {
+		pi.LastUsefulAt = t
+	})
+}
+
+// UpdateLastSuccessfulOutboundQueryAt records the last time we received a
+// successful query response of any kind from p.
+func (rt *RoutingTable) UpdateLastSuccessfulOutboundQueryAt(p peer.ID, t time.Time) {
+	rt.tabLock.Lock()
+	defer rt.tabLock.Unlock()
+	bucket := rt.bucketFor(p)
+	bucket.updatePeerInfo(p, func(pi *PeerInfo) {
+		pi.LastSuccessfulOutboundQueryAt = t
+	})
+}
+
+// MarkReplaceable flags (or unflags) p as an eviction candidate regardless of
+// its usefulness grace period.
+func (rt *RoutingTable) MarkReplaceable(p peer.ID, replaceable bool) {
+	rt.tabLock.Lock()
+	defer rt.tabLock.Unlock()
+	bucket := rt.bucketFor(p)
+	bucket.updatePeerInfo(p, func(pi *PeerInfo) {
+		pi.Replaceable = replaceable
+	})
+}
+
+// NPeersForCpl returns the number of peers in the table whose CPL with the
+// local ID equals cpl.
+func (rt *RoutingTable) NPeersForCpl(cpl uint) int {
+	rt.tabLock.RLock()
+	defer rt.tabLock.RUnlock()
+
+	if int(cpl) < len(rt.Buckets)-1 {
+		return rt.Buckets[cpl].Len()
+	}
+
+	// the wildcard bucket can hold peers of many different CPLs, so we have
+	// to inspect each one individually.
+	count := 0
+	lastBucket := rt.Buckets[len(rt.Buckets)-1]
+	for _, p := range lastBucket.Peers() {
+		if CommonPrefixLen(ConvertPeerID(p), rt.local) == int(cpl) {
+			count++
+		}
+	}
+	return count
+}
+
+// GetPeersForCpl returns all peers in the table whose CPL with the local ID
+// equals cpl.
+func (rt *RoutingTable) GetPeersForCpl(cpl uint) []peer.ID {
+	rt.tabLock.RLock()
+	defer rt.tabLock.RUnlock()
+
+	if int(cpl) < len(rt.Buckets)-1 {
+		return rt.Buckets[cpl].Peers()
+	}
+
+	// the wildcard bucket can hold peers of many different CPLs, so we have
+	// to inspect each one individually.
+	var peers []peer.ID
+	lastBucket := rt.Buckets[len(rt.Buckets)-1]
+	for _, p := range lastBucket.Peers() {
+		if CommonPrefixLen(ConvertPeerID(p), rt.local) == int(cpl) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// GenRandPeerID generates a random peer ID that shares exactly targetCpl
+// bits of common prefix with the local ID. The result is only meaningful as
+// an XOR-keyspace target for a lookup (e.g. to drive bucket refresh); it is
+// not a real, dialable peer.
+func (rt *RoutingTable) GenRandPeerID(targetCpl uint) (peer.ID, error) {
+	rt.tabLock.RLock()
+	localID := make(ID, len(rt.local))
+	copy(localID, rt.local)
+	rt.tabLock.RUnlock()
+
+	if int(targetCpl) >= len(localID)*8 {
+		return "", fmt.Errorf("cannot generate peer ID for cpl %d: exceeds %d-bit keyspace", targetCpl, len(localID)*8)
+	}
+
+	out := make([]byte, len(localID))
+	if _, err := rand.Read(out); err != nil {
+		return "", err
+	}
+
+	byteIdx := targetCpl / 8
+	bitIdx := targetCpl % 8 // 0 == most significant bit of the byte
+
+	// Bytes before byteIdx must match the local ID exactly.
+	copy(out[:byteIdx], localID[:byteIdx])
+
+	// Within byteIdx, bits above bitIdx must match, the bit at bitIdx must
+	// differ (that's what caps the shared prefix at targetCpl), and bits
+	// below it are left random.
+	keepMask := byte(0xFF << (8 - bitIdx))
+	flipBit := byte(1 << (7 - bitIdx))
+	out[byteIdx] = (localID[byteIdx] & keepMask) | (^localID[byteIdx] & flipBit) | (out[byteIdx] &^ (keepMask | flipBit))
+
+	return peer.ID(out), nil
+}
+
+// HandlePeerAlive should be called whenever p is confirmed alive, e.g. a
+// successful connection or query response. It clears its failure count and
+// moves it to the front of its bucket.
+func (rt *RoutingTable) HandlePeerAlive(p peer.ID) {
+	rt.tabLock.Lock()
+	defer rt.tabLock.Unlock()
+
+	bucket := rt.bucketFor(p)
+	bucket.updatePeerInfo(p, func(pi *PeerInfo) {
+		pi.NumFailures = 0
+	})
+	bucket.MoveToFront(p)
+}
+
+// HandlePeerDead should be called whenever p fails a connection attempt or
+// query. It increments the peer's failure count and, once that count
+// reaches maxFailures (or exceeds softMaxFailures with this failure coming
+// within failureGracePeriod of the previous one), removes the peer from the
+// table and fires PeerRemoved.
+func (rt *RoutingTable) HandlePeerDead(p peer.ID) {
+	rt.tabLock.Lock()
+	defer rt.tabLock.Unlock()
+
+	bucket := rt.bucketFor(p)
+	var bad bool
+	found := bucket.updatePeerInfo(p, func(pi *PeerInfo) {
+		prevFailure := pi.LastFailure
+		pi.NumFailures++
+		pi.LastFailure = time.Now()
+		bad = pi.NumFailures >= rt.maxFailures ||
+			(time.Since(prevFailure) < rt.failureGracePeriod && pi.NumFailures > softMaxFailures)
+	})
+
+	if found && bad && bucket.Remove(p) {
+		if rt.diversityFilter != nil {
+			rt.diversityFilter.Remove(p)
+		}
+		rt.PeerRemoved(p)
+		rt.collapseEmptyBuckets()
+	}
+}
+
+// IsBad reports whether p's current failure count and recency would make it
+// eligible for removal by HandlePeerDead.
+func (rt *RoutingTable) IsBad(p peer.ID) bool {
+	rt.tabLock.RLock()
+	defer rt.tabLock.RUnlock()
+
+	pi := rt.bucketFor(p).getPeerInfo(p)
+	if pi == nil {
+		return false
+	}
+	return pi.NumFailures >= rt.maxFailures ||
+		(time.Since(pi.LastFailure) < rt.failureGracePeriod && pi.NumFailures > softMaxFailures)
+}
+
+// bucketFor returns the bucket p currently belongs to. Callers must hold
+// rt.tabLock.
+func (rt *RoutingTable) bucketFor(p peer.ID) *Bucket {
+	cpl := CommonPrefixLen(ConvertPeerID(p), rt.local)
+	bucketID := cpl
+	if bucketID >= len(rt.Buckets) {
+		bucketID = len(rt.Buckets) - 1
+	}
+	return rt.Buckets[bucketID]
+}
+
+// PeerInfo returns a copy of the PeerInfo tracked for p, or nil if p isn't
+// currently in the table. Unlike bucketFor, it takes rt.tabLock itself, so
+// it's safe to call without already holding the lock.
+func (rt *RoutingTable) PeerInfo(p peer.ID) *PeerInfo {
+	rt.tabLock.RLock()
+	defer rt.tabLock.RUnlock()
+	return rt.bucketFor(p).getPeerInfo(p)
+}
+
 // Remove deletes a peer from the routing table. This is to be used
 // when we are sure a node has disconnected completely.
 func (rt *RoutingTable) Remove(p peer.ID) {
@@ -125,7 +442,26 @@ func (rt *RoutingTable) Remove(p peer.ID) {
 
 	bucket := rt.Buckets[bucketID]
 	if bucket.Remove(p) {
+		if rt.diversityFilter != nil {
+			rt.diversityFilter.Remove(p)
+		}
 		rt.PeerRemoved(p)
+		rt.collapseEmptyBuckets()
+	}
+}
+
+// collapseEmptyBuckets pops trailing empty buckets off the table, folding
+// them back into their predecessor, so the table shrinks back down after
+// churn instead of accumulating stale empty buckets left over from earlier
+// unfolding. Callers must hold rt.tabLock.
+func (rt *RoutingTable) collapseEmptyBuckets() {
+	for len(rt.Buckets) > 1 {
+		last := rt.Buckets[len(rt.Buckets)-1]
+		predecessor := rt.Buckets[len(rt.Buckets)-2]
+		if last.Len() != 0 || predecessor.Len() >= rt.bucketsize {
+			break
+		}
+		rt.Buckets = rt.Buckets[:len(rt.Buckets)-1]
 	}
 }
 
@@ -242,7 +578,7 @@ func (rt *RoutingTable) Print() {
 
 		b.lk.RLock()
 		for e := b.list.Front(); e != nil; e = e.Next() {
-			p := e.Value.(peer.ID)
+			p := e.Value.(*PeerInfo).Id
 			fmt.Printf("\t\t- %s %s\n", p.Pretty(), rt.metrics.LatencyEWMA(p).String())
 		}
 		b.lk.RUnlock()
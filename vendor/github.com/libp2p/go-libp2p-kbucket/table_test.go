@@ -0,0 +1,226 @@
+package kbucket
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// randPeerID returns a random peer.ID, used where the exact ID doesn't
+// matter.
+func randPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	// peer.IDFromBytes only accepts a valid multihash, so build a sha2-256
+	// one (code 0x12, length 0x20) around a random 32-byte digest.
+	buf := make([]byte, 34)
+	buf[0], buf[1] = 0x12, 0x20
+	if _, err := rand.Read(buf[2:]); err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromBytes(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// randPeerIDWithCPL brute-forces a random peer.ID whose CPL with local is
+// exactly cpl. This mirrors how other kbucket tests manufacture IDs for a
+// specific bucket since CPL can't be targeted directly.
+func randPeerIDWithCPL(t *testing.T, local ID, cpl uint) peer.ID {
+	t.Helper()
+	for i := 0; i < 100000; i++ {
+		p := randPeerID(t)
+		if uint(CommonPrefixLen(ConvertPeerID(p), local)) == cpl {
+			return p
+		}
+	}
+	t.Fatalf("failed to generate a peer ID with cpl %d", cpl)
+	return ""
+}
+
+func TestNPeersAndGetPeersForCpl(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+	rt := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	for i := uint(0); i < 3; i++ {
+		for j := 0; j < 2; j++ {
+			p := randPeerIDWithCPL(t, local, i)
+			if _, err := rt.Update(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := uint(0); i < 3; i++ {
+		if n := rt.NPeersForCpl(i); n != 2 {
+			t.Errorf("expected 2 peers at cpl %d, got %d", i, n)
+		}
+		if ps := rt.GetPeersForCpl(i); len(ps) != 2 {
+			t.Errorf("expected 2 peers returned for cpl %d, got %d", i, len(ps))
+		}
+	}
+}
+
+func TestRemoveCollapsesEmptyBuckets(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+	rt := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	// A wildcard bucket holding exactly bucketsize peers hasn't unfolded yet
+	// (unfolding only happens on the *next* insert past capacity), so push
+	// one peer past bucketsize to force a split before we exercise collapse.
+	var added []peer.ID
+	for i := uint(0); i < 3; i++ {
+		p := randPeerIDWithCPL(t, local, i)
+		if _, err := rt.Update(p); err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, p)
+	}
+	for j := 0; j < 2; j++ {
+		p := randPeerIDWithCPL(t, local, 3)
+		if _, err := rt.Update(p); err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, p)
+	}
+
+	bucketsBeforeRemoval := len(rt.Buckets)
+	if bucketsBeforeRemoval < 2 {
+		t.Fatalf("expected the table to have unfolded into multiple buckets, got %d", bucketsBeforeRemoval)
+	}
+
+	for _, p := range added {
+		rt.Remove(p)
+	}
+
+	if len(rt.Buckets) != 1 {
+		t.Errorf("expected empty trailing buckets to collapse back to 1, got %d", len(rt.Buckets))
+	}
+}
+
+func TestUpdateEvictsReplaceablePeerOnFullBucket(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+	rt := NewRoutingTable(2, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	p1 := randPeerIDWithCPL(t, local, 0)
+	p2 := randPeerIDWithCPL(t, local, 0)
+	if _, err := rt.Update(p1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Update(p2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither peer is replaceable yet and both are fresh, so a third peer
+	// sharing their bucket should be rejected outright.
+	p3 := randPeerIDWithCPL(t, local, 0)
+	if _, err := rt.Update(p3); err != ErrPeerRejectedNoCapacity {
+		t.Fatalf("expected ErrPeerRejectedNoCapacity, got %v", err)
+	}
+
+	rt.MarkReplaceable(p1, true)
+
+	evicted, err := rt.Update(p3)
+	if err != nil {
+		t.Fatalf("expected p3 to be admitted by evicting a replaceable peer, got err: %s", err)
+	}
+	if evicted != p1 {
+		t.Errorf("expected p1 to be evicted, got %s", evicted)
+	}
+	if rt.Find(p1) != "" {
+		t.Errorf("expected p1 to be gone from the table")
+	}
+	if rt.Find(p3) == "" {
+		t.Errorf("expected p3 to have been admitted")
+	}
+}
+
+// rejectAllDiversityFilter is a PeerDiversityFilter stub that always refuses
+// admission, so tests can exercise Update's diversity-rejection path without
+// depending on the default filter's IP-grouping logic.
+type rejectAllDiversityFilter struct{}
+
+func (rejectAllDiversityFilter) Allow(bucketID int, p peer.ID, addrs []ma.Multiaddr) bool { return false }
+func (rejectAllDiversityFilter) Remove(p peer.ID)                                         {}
+
+func TestUpdateDiversityRejectionDoesNotEvict(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+	rt := NewRoutingTable(2, local, time.Hour, pstore.NewMetrics(), 5, time.Minute)
+
+	p1 := randPeerIDWithCPL(t, local, 0)
+	p2 := randPeerIDWithCPL(t, local, 0)
+	if _, err := rt.Update(p1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Update(p2); err != nil {
+		t.Fatal(err)
+	}
+	// Mark p1 replaceable so a diversity-admitted newcomer would be able to
+	// evict it; the point of this test is that it never gets the chance to.
+	rt.MarkReplaceable(p1, true)
+
+	var removed int
+	rt.PeerRemoved = func(peer.ID) { removed++ }
+	rt.SetDiversityFilter(rejectAllDiversityFilter{})
+
+	p3 := randPeerIDWithCPL(t, local, 0)
+	if _, err := rt.Update(p3); err != ErrPeerRejectedNoDiversity {
+		t.Fatalf("expected ErrPeerRejectedNoDiversity, got %v", err)
+	}
+
+	if removed != 0 {
+		t.Errorf("expected no eviction to occur on a diversity rejection, got %d", removed)
+	}
+	if rt.Find(p1) == "" {
+		t.Errorf("expected p1 to remain in the table: a diversity rejection must not evict the replaceable incumbent")
+	}
+	if rt.Find(p3) != "" {
+		t.Errorf("expected p3 to have been rejected, not admitted")
+	}
+}
+
+func TestHandlePeerDeadQuarantine(t *testing.T) {
+	local := ConvertPeerID(randPeerID(t))
+
+	t.Run("clustered failures within the grace period remove the peer early", func(t *testing.T) {
+		rt := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 100, time.Hour)
+		p := randPeerID(t)
+		if _, err := rt.Update(p); err != nil {
+			t.Fatal(err)
+		}
+
+		// softMaxFailures is 2: a 3rd failure arriving well within
+		// failureGracePeriod of the 2nd should remove the peer even though
+		// maxFailures (100) is nowhere close.
+		rt.HandlePeerDead(p)
+		rt.HandlePeerDead(p)
+		rt.HandlePeerDead(p)
+
+		if rt.Find(p) != "" {
+			t.Errorf("expected peer to have been quarantined out of the table")
+		}
+	})
+
+	t.Run("failures spaced beyond the grace period do not trip the soft limit", func(t *testing.T) {
+		rt := NewRoutingTable(4, local, time.Hour, pstore.NewMetrics(), 100, 10*time.Millisecond)
+		p := randPeerID(t)
+		if _, err := rt.Update(p); err != nil {
+			t.Fatal(err)
+		}
+
+		rt.HandlePeerDead(p)
+		time.Sleep(20 * time.Millisecond)
+		rt.HandlePeerDead(p)
+		time.Sleep(20 * time.Millisecond)
+		rt.HandlePeerDead(p)
+
+		if rt.Find(p) == "" {
+			t.Errorf("expected peer to survive: failures were spaced past failureGracePeriod and maxFailures wasn't reached")
+		}
+	})
+}